@@ -0,0 +1,253 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var errCompressResponseWriterNotHijackable = errors.New("underlying ResponseWriter does not support hijacking")
+
+// defaultCompressMinSize is used when objectnode.compressMinSize is left
+// unconfigured (zero).
+const defaultCompressMinSize = 860
+
+// compressibleContentTypes is the allow-list of response content types
+// eligible for compression. Object payloads (application/octet-stream and
+// the like) are intentionally excluded: they are typically already
+// compressed or are large binary blobs for which gzip/zstd buy little.
+var compressibleContentTypes = []string{
+	"text/",
+	"application/json",
+	"application/xml",
+}
+
+func isCompressibleContentType(contentType string) bool {
+	contentType = strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	for _, allowed := range compressibleContentTypes {
+		if strings.HasSuffix(allowed, "/") {
+			if strings.HasPrefix(contentType, allowed) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(contentType, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// negotiateEncoding picks the best compression encoding offered by the
+// client's Accept-Encoding header, preferring zstd over gzip when both are
+// acceptable. It returns "" when the client did not offer an encoding this
+// middleware supports, in which case the response must pass through
+// untouched (including Content-Length).
+func negotiateEncoding(acceptEncoding string) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+	var hasGzip, hasZstd bool
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		switch strings.TrimSpace(strings.SplitN(part, ";", 2)[0]) {
+		case "zstd":
+			hasZstd = true
+		case "gzip":
+			hasGzip = true
+		}
+	}
+	if hasZstd {
+		return "zstd"
+	}
+	if hasGzip {
+		return "gzip"
+	}
+	return ""
+}
+
+// compressionMiddleware wraps every handler registered by
+// registerApiRouters with Accept-Encoding negotiated gzip/zstd response
+// compression, restricted to the content types in compressibleContentTypes
+// and to responses at least objectnode.compressMinSize bytes long.
+func (o *ObjectNode) compressionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" {
+			// Client offered nothing we support: pass the response through
+			// unaltered, Content-Length included.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		minSize := o.config.CompressMinSize
+		if minSize <= 0 {
+			minSize = defaultCompressMinSize
+		}
+
+		cw := &compressResponseWriter{
+			ResponseWriter: w,
+			request:        r,
+			encoding:       encoding,
+			minSize:        minSize,
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter buffers the response up to minSize bytes so it can
+// decide, once the content type (and therefore compressibility) is known,
+// whether to compress. Once the decision is made the buffered prefix and
+// all subsequent writes are streamed through the chosen encoder (or written
+// through unchanged).
+type compressResponseWriter struct {
+	http.ResponseWriter
+	request  *http.Request
+	encoding string
+	minSize  int
+
+	decided    bool
+	compress   bool
+	buf        []byte
+	statusCode int
+	gzw        *gzip.Writer
+	zsw        *zstd.Encoder
+}
+
+func (w *compressResponseWriter) WriteHeader(status int) {
+	w.statusCode = status
+}
+
+func (w *compressResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	if !w.decided {
+		w.buf = append(w.buf, p...)
+		if len(w.buf) < w.minSize {
+			return len(p), nil
+		}
+		w.decide()
+		return len(p), w.flushBuffered()
+	}
+	if !w.compress {
+		return w.ResponseWriter.Write(p)
+	}
+	return w.encoderWrite(p)
+}
+
+// decide inspects the content type and the already stored Content-Encoding
+// (objects the caller PUT with their own encoding must never be
+// double-compressed) and chooses whether this response will be compressed.
+func (w *compressResponseWriter) decide() {
+	w.decided = true
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	header := w.ResponseWriter.Header()
+	if header.Get("Content-Encoding") != "" {
+		w.compress = false
+	} else {
+		w.compress = isCompressibleContentType(header.Get("Content-Type"))
+	}
+	if w.compress {
+		header.Set("Content-Encoding", w.encoding)
+		// net/http switches to chunked transfer encoding itself once it
+		// sees a response with no Content-Length; setting the header by
+		// hand here would just fight the stdlib over who owns framing.
+		header.Del("Content-Length")
+		switch w.encoding {
+		case "zstd":
+			w.zsw, _ = zstd.NewWriter(w.ResponseWriter)
+		default:
+			w.gzw = gzip.NewWriter(w.ResponseWriter)
+		}
+	}
+	w.ResponseWriter.WriteHeader(w.statusCode)
+}
+
+func (w *compressResponseWriter) flushBuffered() error {
+	buffered := w.buf
+	w.buf = nil
+	if !w.compress {
+		_, err := w.ResponseWriter.Write(buffered)
+		return err
+	}
+	_, err := w.encoderWrite(buffered)
+	return err
+}
+
+func (w *compressResponseWriter) encoderWrite(p []byte) (int, error) {
+	if w.zsw != nil {
+		return w.zsw.Write(p)
+	}
+	return w.gzw.Write(p)
+}
+
+// Close flushes and closes whichever encoder is active, or, for a response
+// that never reached minSize, flushes the buffered bytes uncompressed.
+func (w *compressResponseWriter) Close() error {
+	if !w.decided {
+		// The response stayed below minSize, so it is written through
+		// uncompressed whatever its content type.
+		w.decided = true
+		if w.statusCode == 0 {
+			w.statusCode = http.StatusOK
+		}
+		w.ResponseWriter.WriteHeader(w.statusCode)
+		return w.flushBuffered()
+	}
+	if w.gzw != nil {
+		return w.gzw.Close()
+	}
+	if w.zsw != nil {
+		return w.zsw.Close()
+	}
+	return nil
+}
+
+// Flush lets handlers that stream incremental output (long-running listings,
+// chunked GET ranges, ...) push what they have so far. It flushes the
+// active encoder before flushing the underlying ResponseWriter so buffered
+// compressed bytes are not left stuck in the encoder's internal buffer.
+func (w *compressResponseWriter) Flush() {
+	if w.gzw != nil {
+		_ = w.gzw.Flush()
+	}
+	if w.zsw != nil {
+		_ = w.zsw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack forwards to the underlying ResponseWriter so handlers that need a
+// raw connection (e.g. to implement their own streaming protocol) still
+// work when wrapped by this middleware.
+func (w *compressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errCompressResponseWriterNotHijackable
+	}
+	return hijacker.Hijack()
+}
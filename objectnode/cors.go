@@ -0,0 +1,367 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// corsConfigXAttrKey is the extended attribute key under which a bucket's
+// CORS configuration document is stored on the bucket root inode.
+const corsConfigXAttrKey = "s3:cors"
+
+// bucketRootPath is the path under which bucket-level (as opposed to
+// object-level) extended attributes, such as CORS and lifecycle
+// configuration, are stored on the bucket's root inode.
+const bucketRootPath = "/"
+
+const (
+	headerNameOrigin                     = "Origin"
+	headerNameAccessControlRequestMethod = "Access-Control-Request-Method"
+	headerNameAccessControlRequestHeader = "Access-Control-Request-Headers"
+	headerNameAllowOrigin                = "Access-Control-Allow-Origin"
+	headerNameAllowMethods               = "Access-Control-Allow-Methods"
+	headerNameAllowHeaders               = "Access-Control-Allow-Headers"
+	headerNameAllowCredentials           = "Access-Control-Allow-Credentials"
+	headerNameExposeHeaders              = "Access-Control-Expose-Headers"
+	headerNameMaxAge                     = "Access-Control-Max-Age"
+	headerNameVary                       = "Vary"
+)
+
+// CORSRule mirrors a single <CORSRule> element of an S3 CORS configuration.
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_CORSRule.html
+type CORSRule struct {
+	AllowedOrigin []string `xml:"AllowedOrigin"`
+	AllowedMethod []string `xml:"AllowedMethod"`
+	AllowedHeader []string `xml:"AllowedHeader"`
+	ExposeHeader  []string `xml:"ExposeHeader"`
+	MaxAgeSeconds int      `xml:"MaxAgeSeconds"`
+}
+
+// CORSConfiguration mirrors the <CORSConfiguration> document accepted by
+// PutBucketCors.
+type CORSConfiguration struct {
+	XMLName xml.Name   `xml:"CORSConfiguration"`
+	Rules   []CORSRule `xml:"CORSRule"`
+}
+
+// matchRule returns the first rule that allows origin, method and headers,
+// following the matching semantics described at
+// https://docs.aws.amazon.com/AmazonS3/latest/userguide/cors.html: an
+// AllowedOrigin of "*" matches any origin, methods/headers are matched
+// case-insensitively and AllowedHeader also supports a trailing "*"
+// wildcard.
+func (c *CORSConfiguration) matchRule(origin, method string, headers []string) *CORSRule {
+	if c == nil {
+		return nil
+	}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if !matchesAny(rule.AllowedOrigin, origin) {
+			continue
+		}
+		if method != "" && !containsFold(rule.AllowedMethod, method) {
+			continue
+		}
+		if !headersAllowed(rule.AllowedHeader, headers) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+func matchesAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if p == "*" {
+			return true
+		}
+		if strings.EqualFold(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, target string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func headersAllowed(allowed []string, requested []string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	for _, h := range requested {
+		if !headerMatchesAny(allowed, h) {
+			return false
+		}
+	}
+	return true
+}
+
+// headerMatchesAny is matchesAny for AllowedHeader patterns, which may also
+// end in a "*" wildcard matching any header name with that prefix.
+func headerMatchesAny(patterns []string, value string) bool {
+	for _, p := range patterns {
+		if prefix := strings.TrimSuffix(p, "*"); prefix != p {
+			if strings.HasPrefix(strings.ToLower(value), strings.ToLower(prefix)) {
+				return true
+			}
+			continue
+		}
+		if strings.EqualFold(p, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// getBucketCORS loads and parses the CORS configuration stored on the
+// bucket, returning (nil, nil) when none has been set.
+func (o *ObjectNode) getBucketCORS(vol *Volume) (*CORSConfiguration, error) {
+	raw, err := vol.GetXAttr(bucketRootPath, corsConfigXAttrKey)
+	if err == syscall.ENOENT || len(raw) == 0 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	config := &CORSConfiguration{}
+	if err = xml.Unmarshal(raw, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// corsCacheTTL bounds how stale a cached CORS configuration (or the absence
+// of one) may be before corsConfigForRequest re-fetches it. The hot paths
+// that consult this cache (corsMiddleware, optionsObjectHandler) run on
+// every request carrying an Origin header, so without it each one would
+// cost a GetXAttr metadata round-trip even for the common case of a bucket
+// with no CORS configuration at all.
+const corsCacheTTL = 30 * time.Second
+
+type corsCacheEntry struct {
+	config   *CORSConfiguration
+	expireAt time.Time
+}
+
+// corsConfigForRequest is the cached equivalent of getBucketCORS, keyed by
+// bucket name. A cache hit, including a cached "no CORS configured" result,
+// costs no metadata round-trip at all.
+func (o *ObjectNode) corsConfigForRequest(bucket string, vol *Volume) (*CORSConfiguration, error) {
+	if cached, ok := o.corsCache.Load(bucket); ok {
+		entry := cached.(*corsCacheEntry)
+		if time.Now().Before(entry.expireAt) {
+			return entry.config, nil
+		}
+	}
+	config, err := o.getBucketCORS(vol)
+	if err != nil {
+		return nil, err
+	}
+	o.corsCache.Store(bucket, &corsCacheEntry{config: config, expireAt: time.Now().Add(corsCacheTTL)})
+	return config, nil
+}
+
+// invalidateBucketCORSCache drops any cached entry for bucket so a
+// PutBucketCors/DeleteBucketCors takes effect immediately rather than
+// waiting out corsCacheTTL.
+func (o *ObjectNode) invalidateBucketCORSCache(bucket string) {
+	o.corsCache.Delete(bucket)
+}
+
+// getBucketCORSHandler handles GET /{bucket}?cors .
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketCors.html
+func (o *ObjectNode) getBucketCORSHandler(w http.ResponseWriter, r *http.Request) {
+	param := ParseRequestParam(r)
+	vol, err := o.getVol(param.Bucket())
+	if err != nil {
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	config, err := o.getBucketCORS(vol)
+	if err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if config == nil {
+		errorCode := NoSuchCORSConfiguration
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	data, err := xml.Marshal(config)
+	if err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	w.Header().Set(HeaderNameContentType, HeaderValueContentTypeXML)
+	if _, err = w.Write(data); err != nil {
+		log.LogErrorf("getBucketCORSHandler: write response body fail: requestID(%v) err(%v)", GetRequestID(r), err)
+	}
+}
+
+// putBucketCORSHandler handles PUT /{bucket}?cors .
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketCors.html
+func (o *ObjectNode) putBucketCORSHandler(w http.ResponseWriter, r *http.Request) {
+	param := ParseRequestParam(r)
+	vol, err := o.getVol(param.Bucket())
+	if err != nil {
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	config := &CORSConfiguration{}
+	if err = xml.Unmarshal(body, config); err != nil {
+		errorCode := MalformedXML
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if err = vol.SetXAttr(bucketRootPath, corsConfigXAttrKey, body); err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	o.invalidateBucketCORSCache(param.Bucket())
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteBucketCORSHandler handles DELETE /{bucket}?cors .
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketCors.html
+func (o *ObjectNode) deleteBucketCORSHandler(w http.ResponseWriter, r *http.Request) {
+	param := ParseRequestParam(r)
+	vol, err := o.getVol(param.Bucket())
+	if err != nil {
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if err = vol.DeleteXAttr(bucketRootPath, corsConfigXAttrKey); err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	o.invalidateBucketCORSCache(param.Bucket())
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// optionsObjectHandler implements the CORS preflight request described at
+// https://docs.aws.amazon.com/AmazonS3/latest/API/RESTOPTIONSobject.html .
+// It is registered for both the bucket root and any object path.
+func (o *ObjectNode) optionsObjectHandler(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get(headerNameOrigin)
+	if origin == "" {
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	requestMethod := r.Header.Get(headerNameAccessControlRequestMethod)
+	if requestMethod == "" {
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	var requestHeaders []string
+	if raw := r.Header.Get(headerNameAccessControlRequestHeader); raw != "" {
+		for _, h := range strings.Split(raw, ",") {
+			requestHeaders = append(requestHeaders, strings.TrimSpace(h))
+		}
+	}
+
+	bucket := mux.Vars(r)["bucket"]
+	vol, err := o.getVol(bucket)
+	if err != nil {
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	config, err := o.corsConfigForRequest(bucket, vol)
+	if err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	rule := config.matchRule(origin, requestMethod, requestHeaders)
+	if rule == nil {
+		errorCode := AccessForbidden
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	applyCORSHeaders(w.Header(), rule, origin, true)
+	w.WriteHeader(http.StatusOK)
+}
+
+// corsMiddleware re-applies matching CORS rule headers to non-preflight
+// responses, so that a browser performing a simple (non-preflighted)
+// cross-origin request also sees Access-Control-Allow-Origin et al.
+func (o *ObjectNode) corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get(headerNameOrigin)
+		if origin == "" || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bucket := mux.Vars(r)["bucket"]
+		if bucket != "" {
+			if vol, err := o.getVol(bucket); err == nil {
+				if config, err := o.corsConfigForRequest(bucket, vol); err == nil && config != nil {
+					if rule := config.matchRule(origin, r.Method, nil); rule != nil {
+						applyCORSHeaders(w.Header(), rule, origin, false)
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func applyCORSHeaders(header http.Header, rule *CORSRule, origin string, preflight bool) {
+	header.Set(headerNameAllowOrigin, origin)
+	header.Add(headerNameVary, headerNameOrigin)
+	if preflight {
+		header.Set(headerNameAllowMethods, strings.Join(rule.AllowedMethod, ", "))
+		if len(rule.AllowedHeader) > 0 {
+			header.Set(headerNameAllowHeaders, strings.Join(rule.AllowedHeader, ", "))
+		}
+		if rule.MaxAgeSeconds > 0 {
+			header.Set(headerNameMaxAge, strconv.Itoa(rule.MaxAgeSeconds))
+		}
+	}
+	if len(rule.ExposeHeader) > 0 {
+		header.Set(headerNameExposeHeaders, strings.Join(rule.ExposeHeader, ", "))
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// splitDomainList splits a (possibly comma-separated) virtual-hosted domain
+// configuration entry into its individual patterns, trimming whitespace
+// around each one. A plain, comma-free entry is returned unchanged so
+// existing single-domain configurations keep working.
+func splitDomainList(configuredDomain string) []string {
+	var domains []string
+	for _, d := range strings.Split(configuredDomain, ",") {
+		d = strings.TrimSpace(d)
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// isWildcardDomainPattern reports whether a domain pattern contains a "*"
+// wildcard label, e.g. "s3.*.example.com" or "*.cfs.internal".
+func isWildcardDomainPattern(pattern string) bool {
+	return strings.Contains(pattern, "*")
+}
+
+// compileWildcardHostPattern turns a domain pattern into a regular
+// expression that matches "{bucket}.<pattern>", optionally followed by
+// ":{port}", against the Host header of an incoming request. Each "*" in
+// the pattern matches exactly one non-empty, dot-free label, mirroring how
+// S3-compatible gateways match wildcard virtual-hosted domains.
+func compileWildcardHostPattern(pattern string) *regexp.Regexp {
+	escaped := regexp.QuoteMeta(pattern)
+	escaped = strings.ReplaceAll(escaped, `\*`, `[^.]+`)
+	return regexp.MustCompile(`^(.+)\.` + escaped + `(?::[0-9]+)?$`)
+}
+
+// wildcardHostMatcherFunc returns a mux.MatcherFunc that matches any Host
+// header satisfying pattern and, on a match, populates the "bucket" route
+// variable the same way mux's own Host("{bucket:.+}."+domain) matcher
+// would for a non-wildcard domain.
+func wildcardHostMatcherFunc(pattern string) mux.MatcherFunc {
+	re := compileWildcardHostPattern(pattern)
+	return func(r *http.Request, rm *mux.RouteMatch) bool {
+		match := re.FindStringSubmatch(r.Host)
+		if match == nil {
+			return false
+		}
+		if rm.Vars == nil {
+			rm.Vars = make(map[string]string)
+		}
+		rm.Vars["bucket"] = match[1]
+		return true
+	}
+}
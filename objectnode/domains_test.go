@@ -0,0 +1,135 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestSplitDomainList(t *testing.T) {
+	cases := []struct {
+		configured string
+		want       []string
+	}{
+		{"example.com", []string{"example.com"}},
+		{"a.example.com,b.example.com", []string{"a.example.com", "b.example.com"}},
+		{" a.example.com , b.example.com ", []string{"a.example.com", "b.example.com"}},
+		{"*.example.com,s3.*.example.com", []string{"*.example.com", "s3.*.example.com"}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		got := splitDomainList(c.configured)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("splitDomainList(%q) = %v, want %v", c.configured, got, c.want)
+		}
+	}
+}
+
+func TestIsWildcardDomainPattern(t *testing.T) {
+	if isWildcardDomainPattern("example.com") {
+		t.Errorf("example.com should not be a wildcard pattern")
+	}
+	if !isWildcardDomainPattern("*.example.com") {
+		t.Errorf("*.example.com should be a wildcard pattern")
+	}
+	if !isWildcardDomainPattern("s3.*.example.com") {
+		t.Errorf("s3.*.example.com should be a wildcard pattern")
+	}
+}
+
+func TestWildcardHostMatcherFunc(t *testing.T) {
+	matcherFunc := wildcardHostMatcherFunc("s3.*.example.com")
+
+	cases := []struct {
+		host       string
+		wantMatch  bool
+		wantBucket string
+	}{
+		{"my-bucket.s3.us-east.example.com", true, "my-bucket"},
+		{"my-bucket.s3.us-east.example.com:8080", true, "my-bucket"},
+		{"my-bucket.s3.example.com", false, ""},
+		{"my-bucket.other.example.com", false, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Host = c.host
+		rm := &mux.RouteMatch{}
+		matched := matcherFunc(r, rm)
+		if matched != c.wantMatch {
+			t.Errorf("matcherFunc(%q) matched = %v, want %v", c.host, matched, c.wantMatch)
+			continue
+		}
+		if matched && rm.Vars["bucket"] != c.wantBucket {
+			t.Errorf("matcherFunc(%q) bucket = %q, want %q", c.host, rm.Vars["bucket"], c.wantBucket)
+		}
+	}
+}
+
+// TestPathStyleVirtualHostedAndWildcardResolveToSameHandler mirrors the
+// bucketRouters construction in registerApiRouters: one subrouter per
+// configured literal domain, one per wildcard domain pattern, and a
+// path-style fallback, all registering the same handler. It verifies that a
+// path-style request, a virtual-hosted request and a wildcard-host request
+// for the same bucket all reach that one handler with "bucket" resolved to
+// the same value, i.e. the three styles share a single handler set rather
+// than diverging routes that happen to look alike.
+func TestPathStyleVirtualHostedAndWildcardResolveToSameHandler(t *testing.T) {
+	var gotBuckets []string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		gotBuckets = append(gotBuckets, mux.Vars(r)["bucket"])
+		w.WriteHeader(http.StatusOK)
+	}
+
+	router := mux.NewRouter()
+	bRouter := router.PathPrefix("/").Subrouter()
+
+	var bucketRouters []*mux.Router
+	bucketRouters = append(bucketRouters, bRouter.Host("{bucket:.+}.example.org").Subrouter())
+	bucketRouters = append(bucketRouters, bRouter.MatcherFunc(wildcardHostMatcherFunc("s3.*.example.com")).Subrouter())
+	bucketRouters = append(bucketRouters, bRouter.PathPrefix("/{bucket}").Subrouter())
+
+	for _, br := range bucketRouters {
+		br.Methods(http.MethodGet).Path("/object.txt").HandlerFunc(handler)
+	}
+
+	requests := []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/my-bucket/object.txt", nil),
+		withHost(httptest.NewRequest(http.MethodGet, "/object.txt", nil), "my-bucket.example.org"),
+		withHost(httptest.NewRequest(http.MethodGet, "/object.txt", nil), "my-bucket.s3.us-east.example.com"),
+	}
+
+	for _, r := range requests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %v: got status %d, want %d", r, w.Code, http.StatusOK)
+		}
+	}
+
+	want := []string{"my-bucket", "my-bucket", "my-bucket"}
+	if !reflect.DeepEqual(gotBuckets, want) {
+		t.Errorf("resolved buckets = %v, want %v", gotBuckets, want)
+	}
+}
+
+func withHost(r *http.Request, host string) *http.Request {
+	r.Host = host
+	return r
+}
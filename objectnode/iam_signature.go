@@ -0,0 +1,320 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// verifyRequestSignature recomputes the signature for r using identity's
+// secret key and compares it, in constant time, against the signature the
+// caller supplied. The access key id alone (as extracted by
+// extractRequestAccessKey) is public and proves nothing; this is what
+// actually proves the caller holds the matching secret key.
+func verifyRequestSignature(r *http.Request, identity *iamIdentity) bool {
+	query := r.URL.Query()
+	switch {
+	case query.Get("AWSAccessKeyId") != "":
+		return verifySignatureV2Query(r, identity.SecretKey)
+	case query.Get("X-Amz-Credential") != "":
+		return verifySignatureV4Query(r, identity.SecretKey)
+	}
+
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "AWS4-HMAC-SHA256"):
+		return verifySignatureV4Header(r, identity.SecretKey, auth)
+	case strings.HasPrefix(auth, "AWS "):
+		return verifySignatureV2Header(r, identity.SecretKey, auth)
+	}
+	return false
+}
+
+func constantTimeEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// --- SigV2 --------------------------------------------------------------
+
+// canonicalizedResourceV2 builds the CanonicalizedResource component of the
+// SigV2 string-to-sign: the request path plus any of the sub-resource query
+// parameters S3 includes in the signature, sorted and "&"-joined.
+var signedSubResourcesV2 = []string{
+	"acl", "cors", "location", "logging", "notification", "partNumber",
+	"policy", "requestPayment", "tagging", "torrent", "uploadId", "uploads",
+	"versionId", "versioning", "versions", "website", "delete",
+}
+
+func canonicalizedResourceV2(r *http.Request) string {
+	var sub []string
+	query := r.URL.Query()
+	for _, name := range signedSubResourcesV2 {
+		if values, ok := query[name]; ok {
+			if values[0] == "" {
+				sub = append(sub, name)
+			} else {
+				sub = append(sub, name+"="+values[0])
+			}
+		}
+	}
+	sort.Strings(sub)
+	resource := r.URL.Path
+	if len(sub) > 0 {
+		resource += "?" + strings.Join(sub, "&")
+	}
+	return resource
+}
+
+func canonicalizedAmzHeadersV2(r *http.Request) string {
+	var keys []string
+	for name := range r.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			keys = append(keys, lower)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(r.Header.Values(textproto(k)), ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// textproto mimics http.Header's canonical MIME form for a lowercase header
+// name so Header.Values can look it up (net/textproto.CanonicalMIMEHeaderKey
+// is what http.Header uses internally as its key form).
+func textproto(lower string) string {
+	parts := strings.Split(lower, "-")
+	for i, p := range parts {
+		if len(p) > 0 {
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func stringToSignV2(r *http.Request, expiresOrDate string) string {
+	return r.Method + "\n" +
+		r.Header.Get("Content-MD5") + "\n" +
+		r.Header.Get("Content-Type") + "\n" +
+		expiresOrDate + "\n" +
+		canonicalizedAmzHeadersV2(r) +
+		canonicalizedResourceV2(r)
+}
+
+func signV2(secretKey, stringToSign string) string {
+	mac := hmac.New(sha1.New, []byte(secretKey))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignatureV2Query verifies a pre-signed SigV2 URL:
+// ?AWSAccessKeyId=...&Expires=...&Signature=... .
+func verifySignatureV2Query(r *http.Request, secretKey string) bool {
+	query := r.URL.Query()
+	signature := query.Get("Signature")
+	if signature == "" {
+		return false
+	}
+	expected := signV2(secretKey, stringToSignV2(r, query.Get("Expires")))
+	return constantTimeEqual(expected, signature)
+}
+
+// verifySignatureV2Header verifies the header form: "Authorization: AWS
+// {accessKey}:{signature}".
+func verifySignatureV2Header(r *http.Request, secretKey, auth string) bool {
+	rest := strings.TrimPrefix(auth, "AWS ")
+	parts := strings.SplitN(rest, ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	expected := signV2(secretKey, stringToSignV2(r, r.Header.Get("Date")))
+	return constantTimeEqual(expected, parts[1])
+}
+
+// --- SigV4 ----------------------------------------------------------------
+
+const sigV4ConstPayload = "UNSIGNED-PAYLOAD"
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func sigV4SigningKey(secretKey, date, region, service string) []byte {
+	kDate := hmacSHA256([]byte("AWS4"+secretKey), []byte(date))
+	kRegion := hmacSHA256(kDate, []byte(region))
+	kService := hmacSHA256(kRegion, []byte(service))
+	return hmacSHA256(kService, []byte("aws4_request"))
+}
+
+func canonicalHeadersV4(r *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, h := range signedHeaders {
+		h = strings.ToLower(h)
+		var value string
+		if h == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(textproto(h)), ",")
+		}
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(strings.TrimSpace(value))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// uriEncode percent-encodes s per the SigV4 URI-encoding rules (section
+// "Task 1" of the AWS signing docs): every byte is encoded except unreserved
+// characters (A-Z, a-z, 0-9, '-', '_', '.', '~'), and percent-encoded bytes
+// use uppercase hex. r.URL.Query() already percent-decodes values, so this
+// must be applied back before they rejoin the canonical query string,
+// otherwise e.g. the "/" in X-Amz-Credential fails to come out as "%2F" and
+// the canonical request no longer matches what the client signed.
+func uriEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQueryStringV4 builds the CanonicalQueryString component of the
+// SigV4 canonical request: every parameter (except exclude, the signature
+// itself) URI-encoded and sorted by encoded name, then by encoded value.
+func canonicalQueryStringV4(r *http.Request, exclude string) string {
+	query := r.URL.Query()
+	query.Del(exclude)
+	encoded := make(map[string][]string, len(query))
+	var keys []string
+	for k, vs := range query {
+		ek := uriEncode(k)
+		keys = append(keys, ek)
+		for _, v := range vs {
+			encoded[ek] = append(encoded[ek], uriEncode(v))
+		}
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := encoded[k]
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, k+"="+v)
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func canonicalRequestV4(r *http.Request, signedHeaders []string, excludeQuery, payloadHash string) string {
+	return r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		canonicalQueryStringV4(r, excludeQuery) + "\n" +
+		canonicalHeadersV4(r, signedHeaders) + "\n" +
+		strings.Join(signedHeaders, ";") + "\n" +
+		payloadHash
+}
+
+func stringToSignV4(amzDate, credentialScope, canonicalRequest string) string {
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	return "AWS4-HMAC-SHA256\n" + amzDate + "\n" + credentialScope + "\n" + hex.EncodeToString(hashed[:])
+}
+
+// credentialScopeParts splits "{accessKey}/{date}/{region}/{service}/aws4_request".
+func credentialScopeParts(credential string) (date, region, service string, ok bool) {
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 {
+		return "", "", "", false
+	}
+	return parts[1], parts[2], parts[3], true
+}
+
+// verifySignatureV4Header verifies the header form: "Authorization:
+// AWS4-HMAC-SHA256 Credential=.../SignedHeaders=...;...,Signature=...".
+func verifySignatureV4Header(r *http.Request, secretKey, auth string) bool {
+	fields := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fields[kv[0]] = kv[1]
+	}
+	credential, signedHeadersRaw, signature := fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+	if credential == "" || signedHeadersRaw == "" || signature == "" {
+		return false
+	}
+	date, region, service, ok := credentialScopeParts(credential)
+	if !ok {
+		return false
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		return false
+	}
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = sigV4ConstPayload
+	}
+	signedHeaders := strings.Split(signedHeadersRaw, ";")
+	canonicalRequest := canonicalRequestV4(r, signedHeaders, "", payloadHash)
+	credentialScope := date + "/" + region + "/" + service + "/aws4_request"
+	expected := hex.EncodeToString(hmacSHA256(sigV4SigningKey(secretKey, date, region, service), []byte(stringToSignV4(amzDate, credentialScope, canonicalRequest))))
+	return constantTimeEqual(expected, signature)
+}
+
+// verifySignatureV4Query verifies a pre-signed SigV4 URL carrying
+// X-Amz-Credential/X-Amz-SignedHeaders/X-Amz-Signature query parameters.
+func verifySignatureV4Query(r *http.Request, secretKey string) bool {
+	query := r.URL.Query()
+	credential := query.Get("X-Amz-Credential")
+	signedHeadersRaw := query.Get("X-Amz-SignedHeaders")
+	signature := query.Get("X-Amz-Signature")
+	amzDate := query.Get("X-Amz-Date")
+	if credential == "" || signedHeadersRaw == "" || signature == "" || amzDate == "" {
+		return false
+	}
+	date, region, service, ok := credentialScopeParts(credential)
+	if !ok {
+		return false
+	}
+	signedHeaders := strings.Split(signedHeadersRaw, ";")
+	canonicalRequest := canonicalRequestV4(r, signedHeaders, "X-Amz-Signature", sigV4ConstPayload)
+	credentialScope := date + "/" + region + "/" + service + "/aws4_request"
+	expected := hex.EncodeToString(hmacSHA256(sigV4SigningKey(secretKey, date, region, service), []byte(stringToSignV4(amzDate, credentialScope, canonicalRequest))))
+	return constantTimeEqual(expected, signature)
+}
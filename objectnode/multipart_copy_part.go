@@ -0,0 +1,257 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Header names used by the copy-source precondition checks below.
+// These mirror the names already matched against by HeaderNameCopySource
+// in registerBucketHttpPutRouters.
+const (
+	HeaderNameCopySourceRange        = "X-Amz-Copy-Source-Range"
+	HeaderNameCopySourceIfMatch      = "X-Amz-Copy-Source-If-Match"
+	HeaderNameCopySourceIfNoneMatch  = "X-Amz-Copy-Source-If-None-Match"
+	HeaderNameCopySourceIfModified   = "X-Amz-Copy-Source-If-Modified-Since"
+	HeaderNameCopySourceIfUnmodified = "X-Amz-Copy-Source-If-Unmodified-Since"
+)
+
+// CopyPartResult presents the XML body returned by UploadPartCopy.
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_UploadPartCopy.html .
+type CopyPartResult struct {
+	XMLName      xml.Name `xml:"CopyPartResult"`
+	ETag         string   `xml:"ETag"`
+	LastModified string   `xml:"LastModified"`
+}
+
+// copyObjectPartHandler handles the UploadPartCopy variant of CopyObject: the
+// object body for the given part is not taken from the request body but
+// streamed from a byte range of an existing source object, identified by the
+// X-Amz-Copy-Source header. The copied bytes are written through the same
+// storage path used by uploadPartHandler so the resulting part is
+// indistinguishable from one uploaded directly by the client.
+//
+// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_UploadPartCopy.html .
+func (o *ObjectNode) copyObjectPartHandler(w http.ResponseWriter, r *http.Request) {
+	var (
+		err error
+	)
+	param := ParseRequestParam(r)
+	if param.Bucket() == "" {
+		errorCode := InvalidBucketName
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if param.Object() == "" {
+		errorCode := InvalidKey
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	uploadId := param.GetVar("uploadId")
+	partNumberStr := param.GetVar("partNumber")
+	partNumber, err := strconv.ParseUint(partNumberStr, 10, 64)
+	if err != nil {
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	srcBucket, srcObject, err := extractSrcBucketKey(r)
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: extract src bucket/key fail: requestID(%v) err(%v)",
+			GetRequestID(r), err)
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	vol, err := o.getVol(param.Bucket())
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: load volume fail: requestID(%v) volume(%v) err(%v)",
+			GetRequestID(r), param.Bucket(), err)
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	srcVol, err := o.getVol(srcBucket)
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: load source volume fail: requestID(%v) volume(%v) err(%v)",
+			GetRequestID(r), srcBucket, err)
+		errorCode := NoSuchBucket
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	srcFileInfo, err := srcVol.ObjectMeta(srcObject)
+	if err == syscall.ENOENT {
+		errorCode := NoSuchKey
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: get source object meta fail: requestID(%v) volume(%v) path(%v) err(%v)",
+			GetRequestID(r), srcBucket, srcObject, err)
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	if errorCode := checkCopySourcePreconditions(r, srcFileInfo); errorCode != nil {
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	firstByte, lastByte, errorCode := parseCopySourceRange(r, srcFileInfo.Size)
+	if errorCode != nil {
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	fsFileInfo, err := vol.CopyFilePart(param.Object(), uploadId, uint16(partNumber), srcVol, srcObject, firstByte, lastByte)
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: copy part fail: requestID(%v) volume(%v) uploadID(%v) partNumber(%v) err(%v)",
+			GetRequestID(r), param.Bucket(), uploadId, partNumber, err)
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+
+	result := CopyPartResult{
+		ETag:         "\"" + fsFileInfo.ETag + "\"",
+		LastModified: fsFileInfo.ModifyTime.UTC().Format(CopyObjectResultDateFormat),
+	}
+	marshaled, err := xml.Marshal(result)
+	if err != nil {
+		log.LogErrorf("copyObjectPartHandler: marshal response body fail: requestID(%v) err(%v)", GetRequestID(r), err)
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	w.Header().Set(HeaderNameContentType, HeaderValueContentTypeXML)
+	if _, err = w.Write(marshaled); err != nil {
+		log.LogErrorf("copyObjectPartHandler: write response body fail: requestID(%v) err(%v)", GetRequestID(r), err)
+	}
+}
+
+// extractSrcBucketKey parses the X-Amz-Copy-Source header into a bucket and
+// object key, same convention used by copyObjectHandler: the header value is
+// "{bucket}/{object}", optionally URL-escaped and optionally prefixed with
+// "/". The separator between bucket and object may be a literal "/" or,
+// when the whole header was percent-encoded by the client, "%2F" (the
+// route's HeadersRegexp in router.go accepts both) — whichever occurs
+// first is the real separator, and each side is unescaped independently so
+// a percent-encoded key (spaces, unicode, a literal "/") still resolves to
+// the right object.
+func extractSrcBucketKey(r *http.Request) (bucket, object string, err error) {
+	copySource := r.Header.Get(HeaderNameCopySource)
+	copySource = strings.TrimPrefix(copySource, "/")
+
+	slashIdx := strings.Index(copySource, "/")
+	encodedIdx := strings.Index(strings.ToLower(copySource), "%2f")
+
+	var rawBucket, rawObject string
+	switch {
+	case slashIdx >= 0 && (encodedIdx < 0 || slashIdx < encodedIdx):
+		rawBucket, rawObject = copySource[:slashIdx], copySource[slashIdx+1:]
+	case encodedIdx >= 0:
+		rawBucket, rawObject = copySource[:encodedIdx], copySource[encodedIdx+3:]
+	default:
+		return "", "", fmt.Errorf("invalid copy source: %v", copySource)
+	}
+
+	if bucket, err = url.PathUnescape(rawBucket); err != nil {
+		return "", "", fmt.Errorf("invalid copy source: %v", copySource)
+	}
+	if object, err = url.PathUnescape(rawObject); err != nil {
+		return "", "", fmt.Errorf("invalid copy source: %v", copySource)
+	}
+	if bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid copy source: %v", copySource)
+	}
+	return bucket, object, nil
+}
+
+// unquoteETag strips the surrounding double quotes an ETag is normally sent
+// with (per RFC 7232, and as this handler itself emits them in
+// CopyPartResult.ETag above), so a quoted value from an if-match header
+// compares equal to the unquoted value stored on FSFileInfo.ETag.
+func unquoteETag(etag string) string {
+	if len(etag) >= 2 && etag[0] == '"' && etag[len(etag)-1] == '"' {
+		return etag[1 : len(etag)-1]
+	}
+	return etag
+}
+
+// checkCopySourcePreconditions evaluates the x-amz-copy-source-if-* family of
+// conditional headers against the source object metadata, mirroring the
+// semantics of the regular If-Match/If-None-Match/If-Modified-Since family.
+func checkCopySourcePreconditions(r *http.Request, srcFileInfo *FSFileInfo) *ErrorCode {
+	etag := srcFileInfo.ETag
+	if ifMatch := unquoteETag(r.Header.Get(HeaderNameCopySourceIfMatch)); ifMatch != "" && ifMatch != etag {
+		return PreconditionFailed
+	}
+	if ifNoneMatch := unquoteETag(r.Header.Get(HeaderNameCopySourceIfNoneMatch)); ifNoneMatch != "" && ifNoneMatch == etag {
+		return PreconditionFailed
+	}
+	if ifModifiedSince := r.Header.Get(HeaderNameCopySourceIfModified); ifModifiedSince != "" {
+		if t, err := parseHTTPTime(ifModifiedSince); err == nil && !srcFileInfo.ModifyTime.After(t) {
+			return PreconditionFailed
+		}
+	}
+	if ifUnmodifiedSince := r.Header.Get(HeaderNameCopySourceIfUnmodified); ifUnmodifiedSince != "" {
+		if t, err := parseHTTPTime(ifUnmodifiedSince); err == nil && srcFileInfo.ModifyTime.After(t) {
+			return PreconditionFailed
+		}
+	}
+	return nil
+}
+
+// parseCopySourceRange parses the x-amz-copy-source-range header
+// ("bytes=first-last"). When absent the full source object is copied.
+func parseCopySourceRange(r *http.Request, size uint64) (firstByte, lastByte uint64, errorCode *ErrorCode) {
+	rangeHeader := r.Header.Get(HeaderNameCopySourceRange)
+	if rangeHeader == "" {
+		if size == 0 {
+			return 0, 0, nil
+		}
+		return 0, size - 1, nil
+	}
+	rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
+	parts := strings.SplitN(rangeHeader, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, InvalidArgument
+	}
+	first, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, InvalidArgument
+	}
+	last, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, InvalidArgument
+	}
+	if first > last || last >= size {
+		return 0, 0, errInvalidRange
+	}
+	return first, last, nil
+}
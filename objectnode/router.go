@@ -23,11 +23,39 @@ import (
 // register api routers
 func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 
+	o.initIAM()
+	o.initTraceManager()
+
+	// Request/response tracing, applied to every route registered below
+	// (including the admin endpoint itself) so that auth failures raised by
+	// o.iam.Auth are captured as well.
+	router.Use(o.traceMiddleware)
+
+	// Re-applies matching CORS rule headers to non-preflight responses.
+	router.Use(o.corsMiddleware)
+
+	// Negotiated gzip/zstd response compression, restricted to the
+	// configured content-type allow-list.
+	router.Use(o.compressionMiddleware)
+
 	var bucketRouters []*mux.Router
 	bRouter := router.PathPrefix("/").Subrouter()
-	for _, d := range o.domains {
-		bucketRouters = append(bucketRouters, bRouter.Host("{bucket:.+}."+d).Subrouter())
-		bucketRouters = append(bucketRouters, bRouter.Host("{bucket:.+}."+d+":{port:[0-9]+}").Subrouter())
+	for _, configuredDomain := range o.domains {
+		for _, d := range splitDomainList(configuredDomain) {
+			if isWildcardDomainPattern(d) {
+				// Wildcard patterns (e.g. "s3.*.example.com", "*.cfs.internal")
+				// cannot be expressed with mux's literal Host() matcher, so
+				// match them with a MatcherFunc that both tests the Host
+				// header against the pattern and extracts {bucket} itself.
+				// The regex already tolerates an optional trailing ":{port}",
+				// so this single subrouter serves virtual-hosted requests on
+				// every port the ObjectNode listens on.
+				bucketRouters = append(bucketRouters, bRouter.MatcherFunc(wildcardHostMatcherFunc(d)).Subrouter())
+				continue
+			}
+			bucketRouters = append(bucketRouters, bRouter.Host("{bucket:.+}."+d).Subrouter())
+			bucketRouters = append(bucketRouters, bRouter.Host("{bucket:.+}."+d+":{port:[0-9]+}").Subrouter())
+		}
 	}
 	bucketRouters = append(bucketRouters, bRouter.PathPrefix("/{bucket}").Subrouter())
 
@@ -36,12 +64,12 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_HeadObject.html
 		r.Methods(http.MethodHead).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.headObjectHandler, []Action{GetObjectAction}))
+			HandlerFunc(o.iam.Auth(o.headObjectHandler, []Action{GetObjectAction}))
 
 		// Head bucket
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_HeadBucket.html
 		r.Methods(http.MethodHead).
-			HandlerFunc(o.policyCheck(o.headBucketHandler, []Action{ListBucketAction}))
+			HandlerFunc(o.iam.Auth(o.headBucketHandler, []Action{ListBucketAction}))
 	}
 
 	var registerBucketHttpGetRouters = func(r *mux.Router) {
@@ -49,7 +77,7 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html
 		r.Methods(http.MethodGet).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.getObjectHandler, []Action{ListBucketAction})).
+			HandlerFunc(o.iam.Auth(o.getObjectHandler, []Action{ListBucketAction})).
 			Queries("AWSAccessKeyId", "{accessKey:.+}",
 				"Expires", "{expires:[0-9]+}", "Signature", "{signature:.+}")
 
@@ -57,7 +85,7 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html
 		r.Methods(http.MethodGet).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.getObjectHandler, []Action{ListBucketAction})).
+			HandlerFunc(o.iam.Auth(o.getObjectHandler, []Action{ListBucketAction})).
 			Queries("X-Amz-Credential", "{creadential:.+}",
 				"X-Amz-Algorithm", "{algorithm:.+}", "X-Amz-Signature", "{signature:.+}",
 				"X-Amz-Date", "{date:.+}", "X-Amz-SignedHeaders", "{signedHeaders:.+}",
@@ -67,7 +95,7 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectTagging.html
 		r.Methods(http.MethodGet).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.getObjectTagging, []Action{GetBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.getObjectTagging, []Action{GetBucketPolicyAction})).
 			Queries("tagging", "")
 
 		// Get object XAttr
@@ -87,55 +115,61 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObjectAcl.html
 		r.Methods(http.MethodGet).
 			Path("/{objject:.+}").
-			HandlerFunc(o.policyCheck(o.getObjectACLHandler, []Action{GetObjectAclAction})).
+			HandlerFunc(o.iam.Auth(o.getObjectACLHandler, []Action{GetObjectAclAction})).
 			Queries("acl", "")
 
 		// Get object
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetObject.html
 		r.Methods(http.MethodGet).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.getObjectHandler, []Action{GetObjectAction}))
+			HandlerFunc(o.iam.Auth(o.getObjectHandler, []Action{GetObjectAction}))
 
 		// List objects version 2
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.getBucketV2Handler, []Action{ListBucketAction})).
+			HandlerFunc(o.iam.Auth(o.getBucketV2Handler, []Action{ListBucketAction})).
 			Queries("list-type", "2")
 
 		// List multipart uploads
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListMultipartUploads.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.listMultipartUploadsHandler, []Action{ListMultipartUploadPartsAction})).
+			HandlerFunc(o.iam.Auth(o.listMultipartUploadsHandler, []Action{ListMultipartUploadPartsAction})).
 			Queries("uploads", "")
 
 		// List parts
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListParts.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.listPartsHandler, []Action{ListMultipartUploadPartsAction})).
+			HandlerFunc(o.iam.Auth(o.listPartsHandler, []Action{ListMultipartUploadPartsAction})).
 			Queries("uploadId", "{uploadId:.*}")
 
 		// Get bucket location
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketLocation.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.getBucketLocation, []Action{GetBucketLocationAction})).
+			HandlerFunc(o.iam.Auth(o.getBucketLocation, []Action{GetBucketLocationAction})).
 			Queries("location", "")
 
 		// Get bucket policy
 		// https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketPolicy.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.getBucketPolicyHandler, []Action{GetBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.getBucketPolicyHandler, []Action{GetBucketPolicyAction})).
 			Queries("policy", "")
 
 		// Get bucket acl
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketAcl.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.getBucketACLHandler, []Action{GetBucketAclAction})).
+			HandlerFunc(o.iam.Auth(o.getBucketACLHandler, []Action{GetBucketAclAction})).
 			Queries("acl", "")
 
+		// Get bucket CORS configuration
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_GetBucketCors.html
+		r.Methods(http.MethodGet).
+			HandlerFunc(o.iam.Auth(o.getBucketCORSHandler, []Action{GetBucketCorsAction})).
+			Queries("cors", "")
+
 		// List objects version 1
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjects.html
 		r.Methods(http.MethodGet).
-			HandlerFunc(o.policyCheck(o.getBucketV1Handler, []Action{ListBucketAction}))
+			HandlerFunc(o.iam.Auth(o.getBucketV1Handler, []Action{ListBucketAction}))
 	}
 
 	var registerBucketHttpPostRouters = func(r *mux.Router) {
@@ -143,29 +177,43 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_CreateMultipartUpload.html
 		r.Methods(http.MethodPost).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.createMultipleUploadHandler, []Action{PutObjectAction})).
+			HandlerFunc(o.iam.Auth(o.createMultipleUploadHandler, []Action{PutObjectAction})).
 			Queries("uploads", "")
 
 		// Complete multipart
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_CompleteMultipartUpload.html
 		r.Methods(http.MethodPost).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.completeMultipartUploadHandler, []Action{PutObjectAction})).
+			HandlerFunc(o.iam.Auth(o.completeMultipartUploadHandler, []Action{PutObjectAction})).
 			Queries("uploadId", "{uploadId:.*}")
 
 		// Delete objects (multiple objects)
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObjects.html
 		r.Methods(http.MethodPost).
-			HandlerFunc(o.policyCheck(o.deleteObjectsHandler, []Action{DeleteObjectAction})).
+			HandlerFunc(o.iam.Auth(o.deleteObjectsHandler, []Action{DeleteObjectAction})).
 			Queries("delete", "")
 	}
 
 	var registerBucketHttpPutRouters = func(r *mux.Router) {
+		// Copy object part (copy a byte range of an existing object into a multipart upload part)
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_UploadPartCopy.html .
+		// Notes: this must be registered before both the plain UploadPart and
+		// CopyObject routes below — a PUT carrying partNumber/uploadId *and*
+		// X-Amz-Copy-Source would otherwise be shadowed by the broader
+		// UploadPart route (which has no copy-source constraint) and, failing
+		// that, by CopyObject (which has no partNumber/uploadId constraint),
+		// leaving this handler unreachable.
+		r.Methods(http.MethodPut).
+			Path("/{object:.+}").
+			HeadersRegexp(HeaderNameCopySource, ".*?(\\/|%2F).*?").
+			HandlerFunc(o.iam.Auth(o.copyObjectPartHandler, []Action{PutObjectAction})).
+			Queries("partNumber", "{partNumber:[0-9]+}", "uploadId", "{uploadId:.*}")
+
 		// Upload part
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_UploadPart.html .
 		r.Methods(http.MethodPut).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.uploadPartHandler, []Action{PutObjectAction})).
+			HandlerFunc(o.iam.Auth(o.uploadPartHandler, []Action{PutObjectAction})).
 			Queries("partNumber", "{partNumber:[0-9]+}", "uploadId", "{uploadId:.*}")
 
 		// Copy object
@@ -173,13 +221,13 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		r.Methods(http.MethodPut).
 			Path("/{object:.+}").
 			HeadersRegexp(HeaderNameCopySource, ".*?(\\/|%2F).*?").
-			HandlerFunc(o.policyCheck(o.copyObjectHandler, []Action{PutObjectAction}))
+			HandlerFunc(o.iam.Auth(o.copyObjectHandler, []Action{PutObjectAction}))
 
 		// Put object tagging
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObjectTagging.html
 		r.Methods(http.MethodPut).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.putObjectTagging, []Action{PutBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.putObjectTagging, []Action{PutBucketPolicyAction})).
 			Queries("tagging", "")
 
 		// Put object xattrs
@@ -193,26 +241,32 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketAcl.html
 		r.Methods(http.MethodPut).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.putObjectACLHandler, []Action{PutObjectAclAction})).
+			HandlerFunc(o.iam.Auth(o.putObjectACLHandler, []Action{PutObjectAclAction})).
 			Queries("acl", "")
 
 		// Put object
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutObject.html
 		r.Methods(http.MethodPut).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.putObjectHandler, []Action{PutObjectAction}))
+			HandlerFunc(o.iam.Auth(o.putObjectHandler, []Action{PutObjectAction}))
 
 		// Put bucket acl
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketAcl.html
 		r.Methods(http.MethodPut).
-			HandlerFunc(o.policyCheck(o.putBucketACLHandler, []Action{PutBucketAclAction})).
+			HandlerFunc(o.iam.Auth(o.putBucketACLHandler, []Action{PutBucketAclAction})).
 			Queries("acl", "")
 
 		// Put bucket policy
 		// https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketPolicy.html
 		r.Methods(http.MethodPut).
-			HandlerFunc(o.policyCheck(o.putBucketPolicyHandler, []Action{PutBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.putBucketPolicyHandler, []Action{PutBucketPolicyAction})).
 			Queries("policy", "")
+
+		// Put bucket CORS configuration
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_PutBucketCors.html
+		r.Methods(http.MethodPut).
+			HandlerFunc(o.iam.Auth(o.putBucketCORSHandler, []Action{PutBucketCorsAction})).
+			Queries("cors", "")
 	}
 
 	var registerBucketHttpDeleteRouters = func(r *mux.Router) {
@@ -220,14 +274,14 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_AbortMultipartUpload.html .
 		r.Methods(http.MethodDelete).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.abortMultipartUploadHandler, []Action{AbortMultipartUploadAction})).
+			HandlerFunc(o.iam.Auth(o.abortMultipartUploadHandler, []Action{AbortMultipartUploadAction})).
 			Queries("uploadId", "{uploadId:.*}")
 
 		// Delete object tagging
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObjectTagging.html
 		r.Methods(http.MethodDelete).
 			Path("/{object:.+").
-			HandlerFunc(o.policyCheck(o.deleteObjectTagging, []Action{PutBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.deleteObjectTagging, []Action{PutBucketPolicyAction})).
 			Queries("tagging", "")
 
 		// Delete object xattrs
@@ -241,14 +295,33 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteObject.html .
 		r.Methods(http.MethodDelete).
 			Path("/{object:.+}").
-			HandlerFunc(o.policyCheck(o.deleteObjectHandler, []Action{DeleteObjectAction}))
+			HandlerFunc(o.iam.Auth(o.deleteObjectHandler, []Action{DeleteObjectAction}))
 
 		// Delete bucket policy
 		// https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketPolicy.html
 		r.Methods(http.MethodDelete).
-			HandlerFunc(o.policyCheck(o.deleteBucketPolicyHandler, []Action{DeleteBucketPolicyAction})).
+			HandlerFunc(o.iam.Auth(o.deleteBucketPolicyHandler, []Action{DeleteBucketPolicyAction})).
 			Queries("policy", "")
 
+		// Delete bucket CORS configuration
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_DeleteBucketCors.html
+		r.Methods(http.MethodDelete).
+			HandlerFunc(o.iam.Auth(o.deleteBucketCORSHandler, []Action{PutBucketCorsAction})).
+			Queries("cors", "")
+
+	}
+
+	var registerBucketHttpOptionsRouters = func(r *mux.Router) {
+		// CORS preflight for an object under the bucket
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/RESTOPTIONSobject.html
+		r.Methods(http.MethodOptions).
+			Path("/{object:.+}").
+			HandlerFunc(o.optionsObjectHandler)
+
+		// CORS preflight for the bucket itself
+		// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/RESTOPTIONSobject.html
+		r.Methods(http.MethodOptions).
+			HandlerFunc(o.optionsObjectHandler)
 	}
 
 	for _, r := range bucketRouters {
@@ -257,12 +330,19 @@ func (o *ObjectNode) registerApiRouters(router *mux.Router) {
 		registerBucketHttpPostRouters(r)
 		registerBucketHttpPutRouters(r)
 		registerBucketHttpDeleteRouters(r)
+		registerBucketHttpOptionsRouters(r)
 	}
 
 	// List buckets
 	// API reference: https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListBuckets.html
 	router.Methods(http.MethodGet).
-		HandlerFunc(o.policyCheck(o.listBucketsHandler, []Action{ListBucketAction}))
+		HandlerFunc(o.iam.Auth(o.listBucketsHandler, []Action{ListBucketAction}))
+
+	// Admin: enable/disable request tracing at runtime
+	// Notes: ChubaoFS owned API for operational diagnostics
+	router.Methods(http.MethodPost).
+		Path("/admin/trace").
+		HandlerFunc(o.iam.Auth(o.adminTraceHandler, []Action{AdminTraceAction}))
 
 	// Unsupported operation
 	router.NotFoundHandler = http.HandlerFunc(o.unsupportedOperationHandler)
@@ -0,0 +1,291 @@
+// Copyright 2018 The ChubaoFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package objectnode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// traceBodyCapBytes bounds how much of a request/response body is kept
+	// per trace entry so a single large object transfer cannot blow up
+	// memory or the trace log.
+	traceBodyCapBytes = 32 * 1024
+
+	// traceLogRotateSize is the size threshold at which the active trace
+	// log file is rotated.
+	traceLogRotateSize = 256 * 1024 * 1024
+
+	traceRedactedValue = "-REDACTED-"
+)
+
+// skipBodyCapture reports whether the request targets one of the handlers
+// whose bodies are never captured, regardless of size, because they
+// routinely carry full object payloads (PutObject, UploadPart, GetObject).
+func skipBodyCapture(r *http.Request) bool {
+	query := r.URL.Query()
+	// Sub-resources such as ?tagging or ?acl carry an empty value, so
+	// presence is tested on the key rather than with query.Get.
+	has := func(key string) bool {
+		_, ok := query[key]
+		return ok
+	}
+	switch r.Method {
+	case http.MethodPut:
+		// UploadPart: PUT .../{object}?partNumber=N&uploadId=...
+		if query.Get("uploadId") != "" {
+			return true
+		}
+		// PutObject: a plain PUT of the object, not one of the
+		// tagging/xattr/acl/copy sub-resources.
+		if !has("tagging") && !has("xattr") && !has("acl") &&
+			r.Header.Get(HeaderNameCopySource) == "" {
+			return true
+		}
+	case http.MethodGet:
+		// GetObject: a plain GET of the object, not one of the
+		// tagging/xattr/acl/listing sub-resources.
+		if !has("tagging") && !has("xattr") && !has("acl") &&
+			!has("list-type") && !has("uploads") && !has("uploadId") &&
+			!has("location") && !has("policy") {
+			return true
+		}
+	}
+	return false
+}
+
+// traceManager owns the runtime-toggleable trace state for an ObjectNode. It
+// is safe for concurrent use: Enable/Disable may race with in-flight
+// requests recording entries.
+type traceManager struct {
+	enabled int32 // atomic bool, 1 means tracing is active
+
+	mu      sync.Mutex
+	dir     string
+	file    *os.File
+	written int64
+}
+
+func newTraceManager() *traceManager {
+	return &traceManager{}
+}
+
+func (t *traceManager) isEnabled() bool {
+	return atomic.LoadInt32(&t.enabled) == 1
+}
+
+// enable points the manager at dir and opens (or creates) the active trace
+// log file there. It is idempotent: calling it while already enabled just
+// switches the output directory.
+func (t *traceManager) enable(dir string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path.Join(dir, t.currentFileName()), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if t.file != nil {
+		_ = t.file.Close()
+	}
+	t.dir = dir
+	t.file = f
+	t.written = 0
+	atomic.StoreInt32(&t.enabled, 1)
+	return nil
+}
+
+func (t *traceManager) disable() {
+	atomic.StoreInt32(&t.enabled, 0)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file != nil {
+		_ = t.file.Close()
+		t.file = nil
+	}
+}
+
+func (t *traceManager) currentFileName() string {
+	return fmt.Sprintf("trace-%s.log", time.Now().Format("20060102-150405"))
+}
+
+func (t *traceManager) record(entry []byte) {
+	if !t.isEnabled() {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.file == nil {
+		return
+	}
+	n, err := t.file.Write(entry)
+	if err != nil {
+		return
+	}
+	t.written += int64(n)
+	if t.written >= traceLogRotateSize {
+		_ = t.file.Close()
+		f, err := os.OpenFile(path.Join(t.dir, t.currentFileName()), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err == nil {
+			t.file = f
+			t.written = 0
+		}
+	}
+}
+
+// traceMiddleware wraps every handler registered by registerApiRouters. When
+// tracing is disabled it is a zero-cost passthrough; when enabled it records
+// the request line, headers, remote address, and the response status,
+// headers and latency to the rotating trace log.
+func (o *ObjectNode) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if o.traceMgr == nil || !o.traceMgr.isEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		captureBody := !skipBodyCapture(r)
+
+		var reqBody []byte
+		if captureBody && r.Body != nil {
+			limited := io.LimitReader(r.Body, traceBodyCapBytes)
+			reqBody, _ = ioutil.ReadAll(limited)
+			r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(reqBody), r.Body))
+		}
+
+		start := time.Now()
+		rec := &traceResponseWriter{ResponseWriter: w, status: http.StatusOK, captureBody: captureBody}
+		next.ServeHTTP(rec, r)
+
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "---\n%s %s %s\n", r.Method, r.URL.RequestURI(), r.Proto)
+		fmt.Fprintf(&buf, "RemoteAddr: %s\n", r.RemoteAddr)
+		for k, v := range r.Header {
+			fmt.Fprintf(&buf, "> %s: %s\n", k, redactHeaderValue(k, v))
+		}
+		if captureBody && len(reqBody) > 0 {
+			fmt.Fprintf(&buf, ">> body (%d bytes captured)\n", len(reqBody))
+		}
+		fmt.Fprintf(&buf, "< %d\n", rec.status)
+		for k, v := range rec.Header() {
+			fmt.Fprintf(&buf, "< %s: %s\n", k, redactHeaderValue(k, v))
+		}
+		if captureBody && rec.body.Len() > 0 {
+			fmt.Fprintf(&buf, "<< body (%d bytes captured)\n", rec.body.Len())
+		}
+		fmt.Fprintf(&buf, "duration: %s\n", time.Since(start))
+		if buf.Len() > traceBodyCapBytes {
+			buf.Truncate(traceBodyCapBytes)
+			buf.WriteString("...(truncated)\n")
+		}
+		o.traceMgr.record(buf.Bytes())
+	})
+}
+
+// traceResponseWriter captures the status code and, unless captureBody is
+// false, a bounded prefix of the response body written by the wrapped
+// handler so the trace entry can report them.
+type traceResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	captureBody bool
+	body        bytes.Buffer
+}
+
+func (w *traceResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *traceResponseWriter) Write(p []byte) (int, error) {
+	if w.captureBody && w.body.Len() < traceBodyCapBytes {
+		remaining := traceBodyCapBytes - w.body.Len()
+		if remaining > len(p) {
+			remaining = len(p)
+		}
+		w.body.Write(p[:remaining])
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func redactHeaderValue(name string, values []string) []string {
+	switch name {
+	case "Authorization", "X-Amz-Security-Token":
+		redacted := make([]string, len(values))
+		for i := range values {
+			redacted[i] = traceRedactedValue
+		}
+		return redacted
+	default:
+		return values
+	}
+}
+
+// initTraceManager constructs o.traceMgr once, the first time
+// registerApiRouters runs. traceMiddleware reads o.traceMgr on every request
+// without synchronization, so it must never be assigned after requests
+// start flowing; adminTraceHandler only ever calls methods on the instance
+// created here, which are themselves safe for concurrent use.
+func (o *ObjectNode) initTraceManager() {
+	if o.traceMgr != nil {
+		return
+	}
+	o.traceMgr = newTraceManager()
+}
+
+// adminTraceHandler implements POST /admin/trace?enable=1&dir=... so
+// operators can turn request tracing on or off without restarting the
+// object node.
+func (o *ObjectNode) adminTraceHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	enable, err := strconv.ParseBool(query.Get("enable"))
+	if err != nil {
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if !enable {
+		o.traceMgr.disable()
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	dir := query.Get("dir")
+	if dir == "" {
+		dir = o.config.TraceLogDir
+	}
+	if dir == "" {
+		errorCode := InvalidArgument
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	if err = o.traceMgr.enable(dir); err != nil {
+		errorCode := InternalErrorCode(err)
+		errorCode.ServeResponse(w, r)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}